@@ -0,0 +1,31 @@
+package builder
+
+import "fmt"
+
+// BuildBackend selects how the packages layer image is assembled.
+type BuildBackend string
+
+const (
+	// BuildBackendDocker builds the packages layer by streaming a tar
+	// context to a running docker daemon. This is the historical, default
+	// behaviour.
+	BuildBackendDocker BuildBackend = "docker"
+
+	// BuildBackendNative builds the packages layer in-process, without a
+	// docker socket, by parsing the generated Dockerfile and writing the
+	// resulting layers straight into local image storage.
+	BuildBackendNative BuildBackend = "native"
+)
+
+// ParseBuildBackend validates a --build-backend flag value, defaulting to
+// BuildBackendDocker when empty so existing invocations keep working.
+func ParseBuildBackend(value string) (BuildBackend, error) {
+	switch BuildBackend(value) {
+	case "":
+		return BuildBackendDocker, nil
+	case BuildBackendDocker, BuildBackendNative:
+		return BuildBackend(value), nil
+	default:
+		return "", fmt.Errorf("unknown build backend %q, must be one of: docker, native", value)
+	}
+}
@@ -0,0 +1,97 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+
+	// Registered for their side effect of adding themselves to
+	// alltransports, so ParseDestination and CopySource recognise every
+	// scheme fissile builds or pushes through: a remote registry, a
+	// locally running docker daemon, an OCI/docker archive or layout, or
+	// containers-storage.
+	_ "github.com/containers/image/v5/docker"
+	_ "github.com/containers/image/v5/docker/archive"
+	_ "github.com/containers/image/v5/docker/daemon"
+	_ "github.com/containers/image/v5/oci/archive"
+	_ "github.com/containers/image/v5/oci/layout"
+	_ "github.com/containers/image/v5/storage"
+)
+
+// Destination is a parsed reference to where a built packages or role image
+// should end up: an OCI image layout directory, an OCI archive, a remote
+// registry, or local containers-storage, modelled after the transports
+// containers/image supports. It lets fissile write images without shelling
+// out to `docker save`/`docker push`.
+type Destination struct {
+	ref types.ImageReference
+	raw string
+}
+
+// ParseDestination parses a destination reference in containers/image
+// transport syntax, e.g. "oci:/path/to/layout:tag", "oci-archive:/path.tar",
+// "docker://registry.example.com/repo:tag", or "containers-storage:repo:tag".
+func ParseDestination(raw string) (*Destination, error) {
+	if !strings.Contains(raw, ":") {
+		return nil, fmt.Errorf("destination %q is missing a transport prefix (oci:, oci-archive:, docker://, containers-storage:)", raw)
+	}
+
+	ref, err := alltransports.ParseImageName(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing destination %q: %v", raw, err)
+	}
+
+	return &Destination{ref: ref, raw: raw}, nil
+}
+
+// String returns the destination in its original transport syntax, for use
+// in log and error messages.
+func (d *Destination) String() string {
+	return d.raw
+}
+
+// CopyImageOptions controls how an image is copied into a Destination.
+type CopyImageOptions struct {
+	// SourceCtx carries registry auth for the source, if it is remote.
+	SourceCtx *types.SystemContext
+	// DestinationCtx carries registry auth for the destination, if it is
+	// remote.
+	DestinationCtx *types.SystemContext
+}
+
+// CopySource copies an image already resolvable by containers/image (a
+// local containers-storage image, a docker-daemon reference, or another
+// registry) into dst, preserving config labels such as the fingerprint.* and
+// version.generator.fissile labels that determinePackagesLayerBaseImage
+// relies on.
+func CopySource(ctx context.Context, sourceRef string, dst *Destination, opts CopyImageOptions) error {
+	src, err := alltransports.ParseImageName(sourceRef)
+	if err != nil {
+		return fmt.Errorf("parsing source %q: %v", sourceRef, err)
+	}
+
+	policy, err := signature.DefaultPolicy(opts.DestinationCtx)
+	if err != nil {
+		return fmt.Errorf("loading default signature policy: %v", err)
+	}
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return fmt.Errorf("creating policy context: %v", err)
+	}
+	defer policyContext.Destroy()
+
+	_, err = copy.Image(ctx, policyContext, dst.ref, src, &copy.Options{
+		SourceCtx:      opts.SourceCtx,
+		DestinationCtx: opts.DestinationCtx,
+	})
+	if err != nil {
+		return fmt.Errorf("copying %s to %s: %v", sourceRef, dst, err)
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package builder
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
@@ -28,18 +29,38 @@ type PackagesImageBuilder struct {
 	compiledPackagesPath string
 	targetPath           string
 	fissileVersion       string
+	buildBackend         BuildBackend
+	layerMode            PackagesLayerMode
 	ui                   *termui.UI
+
+	// registries lists additional registries
+	// determinePackagesLayerBaseImage consults for a packages layer cache
+	// hit, beyond the local docker daemon; set via SetRegistries.
+	registries []RegistryCache
 }
 
 // baseImageOverride is used for tests; if not set, we use the correct one
 var baseImageOverride string
 
-// NewPackagesImageBuilder creates a new PackagesImageBuilder
-func NewPackagesImageBuilder(repository, stemcellImageName, stemcellImageID, compiledPackagesPath, targetPath, fissileVersion string, ui *termui.UI) (*PackagesImageBuilder, error) {
+// NewPackagesImageBuilder creates a new PackagesImageBuilder. buildBackend
+// selects whether the packages layer is produced by handing a tar context
+// to a docker daemon (BuildBackendDocker) or assembled in-process without
+// one (BuildBackendNative); an empty value defaults to BuildBackendDocker.
+// layerMode selects whether packages share one amalgamated layer
+// (PackagesLayerMonolithic) or get one layer each (PackagesLayerPerPackage);
+// an empty value defaults to PackagesLayerMonolithic.
+func NewPackagesImageBuilder(repository, stemcellImageName, stemcellImageID, compiledPackagesPath, targetPath, fissileVersion string, buildBackend BuildBackend, layerMode PackagesLayerMode, ui *termui.UI) (*PackagesImageBuilder, error) {
 	if err := os.MkdirAll(targetPath, 0755); err != nil {
 		return nil, err
 	}
 
+	if buildBackend == "" {
+		buildBackend = BuildBackendDocker
+	}
+	if layerMode == "" {
+		layerMode = PackagesLayerMonolithic
+	}
+
 	if stemcellImageID == "" {
 		imageManager, err := docker.NewImageManager()
 		if err != nil {
@@ -61,6 +82,8 @@ func NewPackagesImageBuilder(repository, stemcellImageName, stemcellImageID, com
 		compiledPackagesPath: compiledPackagesPath,
 		targetPath:           targetPath,
 		fissileVersion:       fissileVersion,
+		buildBackend:         buildBackend,
+		layerMode:            layerMode,
 		ui:                   ui,
 	}, nil
 }
@@ -114,15 +137,48 @@ func (w *tarWalker) walk(path string, info os.FileInfo, err error) error {
 	return err
 }
 
+// SetRegistries configures the registries determinePackagesLayerBaseImage
+// consults for a packages layer cache hit, in addition to the local docker
+// daemon. Passing no registries (the default) keeps lookups local-only.
+func (p *PackagesImageBuilder) SetRegistries(registries []RegistryCache) {
+	p.registries = registries
+}
+
+// fissileVersionValue is the bare version.generator.fissile label value
+// ("+" replaced to stay docker/OCI label-safe), i.e. what actually gets
+// written as that label's value on a built image.
+func (p *PackagesImageBuilder) fissileVersionValue() string {
+	return strings.Replace(p.fissileVersion, "+", "_", -1)
+}
+
+// fissileVersionLabel is the "key=value" form docker.ImageManager's
+// FindBestImageWithLabels mandatory-labels argument expects.
 func (p *PackagesImageBuilder) fissileVersionLabel() string {
-	return fmt.Sprintf("version.generator.fissile=%s",
-		strings.Replace(p.fissileVersion, "+", "_", -1))
+	return fmt.Sprintf("version.generator.fissile=%s", p.fissileVersionValue())
 }
 
 // determinePackagesLayerBaseImage finds the best base image to use for the
-// packages layer image.  Given a list of packages, it returns the base image
-// name to use, as well as the set of packages that still need to be inserted.
+// packages layer image. Given a list of packages, it returns the base image
+// name to use, as well as the set of packages that still need to be
+// inserted. When the builder has registries configured (see SetRegistries),
+// they are consulted alongside the local docker daemon, and whichever image
+// covers the most of the requested packages wins.
 func (p *PackagesImageBuilder) determinePackagesLayerBaseImage(packages model.Packages) (string, model.Packages, error) {
+	if len(p.registries) > 0 {
+		return p.determinePackagesLayerBaseImageWithRegistries(context.Background(), packages, p.registries)
+	}
+	return p.determinePackagesLayerBaseImageLocal(packages)
+}
+
+// determinePackagesLayerBaseImageLocal is the local-docker-daemon-only half
+// of determinePackagesLayerBaseImage; determinePackagesLayerBaseImageWithRegistries
+// calls this to get the local candidate before comparing it against any
+// configured registries.
+func (p *PackagesImageBuilder) determinePackagesLayerBaseImageLocal(packages model.Packages) (string, model.Packages, error) {
+	if p.layerMode == PackagesLayerPerPackage {
+		return p.determinePackagesLayerBaseImagePerPackage(packages)
+	}
+
 	baseImageName := p.stemcellImageName
 	if baseImageOverride != "" {
 		baseImageName = baseImageOverride
@@ -167,6 +223,59 @@ func (p *PackagesImageBuilder) determinePackagesLayerBaseImage(packages model.Pa
 	return matchedImage, packages, nil
 }
 
+// BuildNatively assembles the packages layer image without a docker daemon,
+// using the BuildBackendNative path. It is only meaningful when the builder
+// was constructed with that backend; callers using BuildBackendDocker should
+// keep driving NewDockerPopulator into a docker.ImageManager as before.
+func (p *PackagesImageBuilder) BuildNatively(roles model.Roles, forceBuildAll bool, graphRoot, graphDriverName string) (string, error) {
+	if p.buildBackend != BuildBackendNative {
+		return "", fmt.Errorf("builder is configured for the %s backend, not %s", p.buildBackend, BuildBackendNative)
+	}
+	if len(roles) == 0 {
+		return "", fmt.Errorf("No roles to build")
+	}
+
+	foundFingerprints := make(map[string]struct{})
+	var packages model.Packages
+	for _, role := range roles {
+		for _, roleJob := range role.RoleJobs {
+			for _, pkg := range roleJob.Packages {
+				if _, ok := foundFingerprints[pkg.Fingerprint]; ok {
+					continue
+				}
+				packages = append(packages, pkg)
+				foundFingerprints[pkg.Fingerprint] = struct{}{}
+			}
+		}
+	}
+
+	var err error
+	baseImageName := p.stemcellImageName
+	if !forceBuildAll {
+		baseImageName, packages, err = p.determinePackagesLayerBaseImage(packages)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	dockerfile := bytes.Buffer{}
+	if err = p.generateDockerfile(baseImageName, packages, &dockerfile); err != nil {
+		return "", err
+	}
+
+	backend, err := newNativeBuildBackend(graphRoot, graphDriverName)
+	if err != nil {
+		return "", err
+	}
+
+	labels := map[string]string{"version.generator.fissile": p.fissileVersionValue()}
+	for _, pkg := range packages {
+		labels[fmt.Sprintf("fingerprint.%s", pkg.Fingerprint)] = "1"
+	}
+
+	return backend.build(dockerfile.Bytes(), p.compiledPackagesPath, packages, labels)
+}
+
 // NewDockerPopulator returns a function which can populate a tar stream with the docker context to build the packages layer image with
 func (p *PackagesImageBuilder) NewDockerPopulator(roles model.Roles, forceBuildAll bool) func(*tar.Writer) error {
 	return func(tarWriter *tar.Writer) error {
@@ -257,7 +366,12 @@ func (p *PackagesImageBuilder) generateDockerfile(baseImage string, packages mod
 	return dockerfileTemplate.Execute(outputFile, context)
 }
 
-// GetPackagesLayerImageName generates a docker image name for the amalgamation holding all packages used in the specified roles
+// GetPackagesLayerImageName generates a docker image name for the packages
+// used in the specified roles. The tag is derived the same way in every
+// PackagesLayerMode. In PackagesLayerMonolithic mode this names the single
+// amalgamated image; in PackagesLayerPerPackage mode no image is built or
+// tagged under this name, as NewPerPackageDockerPopulators tags each layer
+// with PackageLayerImageName instead.
 func (p *PackagesImageBuilder) GetPackagesLayerImageName(roleManifest *model.RoleManifest, roles model.Roles) (string, error) {
 	// Get the list of packages; use the fingerprint to ensure we have no repeats
 	pkgMap := make(map[string]*model.Package)
@@ -287,3 +401,16 @@ func (p *PackagesImageBuilder) GetPackagesLayerImageName(roleManifest *model.Rol
 	imageTag := util.SanitizeDockerName(hex.EncodeToString(hasher.Sum(nil)))
 	return fmt.Sprintf("%s:%s", imageName, imageTag), nil
 }
+
+// PushPackagesLayer copies the already-built packages layer image (as named
+// by GetPackagesLayerImageName, in local containers-storage or the docker
+// daemon, depending on the builder's buildBackend) to dst, e.g. an OCI
+// layout directory or a remote registry. This lets CI publish the layer for
+// other build hosts to consult without a `docker push`.
+func (p *PackagesImageBuilder) PushPackagesLayer(ctx context.Context, imageName string, dst *Destination, opts CopyImageOptions) error {
+	transport := "docker-daemon"
+	if p.buildBackend == BuildBackendNative {
+		transport = "containers-storage"
+	}
+	return CopySource(ctx, fmt.Sprintf("%s:%s", transport, imageName), dst, opts)
+}
@@ -0,0 +1,172 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/SUSE/fissile/docker"
+	"github.com/SUSE/fissile/model"
+	"github.com/SUSE/fissile/util"
+)
+
+// PackagesLayerMode selects how the packages layer is structured on disk.
+type PackagesLayerMode string
+
+const (
+	// PackagesLayerMonolithic bundles every remaining package into a
+	// single Dockerfile-packages layer, keyed by the aggregate
+	// fingerprint set. A single package change invalidates the whole
+	// layer; kept as a compatibility mode for deployments that still
+	// expect one packages layer image.
+	PackagesLayerMonolithic PackagesLayerMode = "monolithic"
+
+	// PackagesLayerPerPackage builds one image layer per package
+	// fingerprint, chained on top of the stemcell and labeled
+	// fingerprint.<sha>=1, so a single package change only invalidates
+	// its own layer and the layers chained after it. An already-built
+	// layer is reused only when every package sorted before it is in the
+	// chain as well; layers are found by their fingerprint label, not
+	// looked up by digest.
+	PackagesLayerPerPackage PackagesLayerMode = "per-package"
+)
+
+// ParsePackagesLayerMode validates a --packages-layer-mode flag value,
+// defaulting to PackagesLayerMonolithic for compatibility with existing
+// deployments.
+func ParsePackagesLayerMode(value string) (PackagesLayerMode, error) {
+	switch PackagesLayerMode(value) {
+	case "":
+		return PackagesLayerMonolithic, nil
+	case PackagesLayerMonolithic, PackagesLayerPerPackage:
+		return PackagesLayerMode(value), nil
+	default:
+		return "", fmt.Errorf("unknown packages layer mode %q, must be one of: monolithic, per-package", value)
+	}
+}
+
+// determinePackagesLayerBaseImagePerPackage walks the chain of per-package
+// fingerprint layers already built on top of the stemcell, in fingerprint
+// order, stopping at the first package that has no layer yet. It returns
+// the topmost already-built layer (or the stemcell, if none are built) as
+// the base image, and the remaining packages that each still need their own
+// layer built on top of it.
+func (p *PackagesImageBuilder) determinePackagesLayerBaseImagePerPackage(packages model.Packages) (string, model.Packages, error) {
+	sorted := make(model.Packages, len(packages))
+	copy(sorted, packages)
+	sort.Sort(sorted)
+
+	dockerManager, err := docker.NewImageManager()
+	if err != nil {
+		return "", nil, err
+	}
+
+	baseImage := p.stemcellImageName
+	if baseImageOverride != "" {
+		baseImage = baseImageOverride
+	}
+	mandatoryLabels := []string{p.fissileVersionLabel()}
+
+	var remaining model.Packages
+	for i, pkg := range sorted {
+		label := fmt.Sprintf("fingerprint.%s", pkg.Fingerprint)
+		layerImage, foundLabels, err := dockerManager.FindBestImageWithLabels(baseImage, []string{label}, mandatoryLabels)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, ok := foundLabels[label]; !ok {
+			// Layers are chained in fingerprint order: once one package
+			// has no layer yet, everything after it still needs its own
+			// layer built on top of it too, in order. Probing later
+			// fingerprints against the same (unchanged) base would both
+			// re-add already-present packages and break that order, so
+			// stop at the first gap.
+			remaining = append(remaining, sorted[i:]...)
+			break
+		}
+		baseImage = layerImage
+	}
+
+	return baseImage, remaining, nil
+}
+
+// PackageLayerImageName returns the deterministic per-fingerprint tag a
+// single package's own layer is built under, independent of which roles
+// happen to use it. Existing layers are found by their fingerprint label,
+// not by this tag.
+func (p *PackagesImageBuilder) PackageLayerImageName(pkg *model.Package) string {
+	imageName := util.SanitizeDockerName(fmt.Sprintf("%s-package", p.repository))
+	imageTag := util.SanitizeDockerName(fmt.Sprintf("fingerprint-%s", pkg.Fingerprint))
+	return fmt.Sprintf("%s:%s", imageName, imageTag)
+}
+
+// NewPerPackageDockerPopulators returns, for each package that still needs
+// its own layer, the tag its image is built under (in build order) and a tar
+// populator keyed by that tag, chained in fingerprint order on top of
+// whatever already-built layers determinePackagesLayerBaseImagePerPackage
+// found. Each populator's Dockerfile already names the previous tag (or that
+// base) in its FROM, so callers build them in the order of the returned
+// tags; a single package change only costs a rebuild of its own layer and
+// everything chained after it.
+func (p *PackagesImageBuilder) NewPerPackageDockerPopulators(roles model.Roles, forceBuildAll bool) ([]string, map[string]func(*tar.Writer) error, error) {
+	if len(roles) == 0 {
+		return nil, nil, fmt.Errorf("No roles to build")
+	}
+
+	foundFingerprints := make(map[string]struct{})
+	var packages model.Packages
+	for _, role := range roles {
+		for _, roleJob := range role.RoleJobs {
+			for _, pkg := range roleJob.Packages {
+				if _, ok := foundFingerprints[pkg.Fingerprint]; ok {
+					continue
+				}
+				packages = append(packages, pkg)
+				foundFingerprints[pkg.Fingerprint] = struct{}{}
+			}
+		}
+	}
+
+	baseImage := p.stemcellImageName
+	if !forceBuildAll {
+		var err error
+		baseImage, packages, err = p.determinePackagesLayerBaseImagePerPackage(packages)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	sort.Sort(packages)
+
+	tags := make([]string, 0, len(packages))
+	populators := make(map[string]func(*tar.Writer) error, len(packages))
+
+	for _, pkg := range packages {
+		pkg := pkg
+		tag := p.PackageLayerImageName(pkg)
+		layerBaseImage := baseImage
+
+		populators[tag] = func(tarWriter *tar.Writer) error {
+			dockerfile := bytes.Buffer{}
+			if err := p.generateDockerfile(layerBaseImage, model.Packages{pkg}, &dockerfile); err != nil {
+				return err
+			}
+			if err := util.WriteToTarStream(tarWriter, dockerfile.Bytes(), tar.Header{Name: "Dockerfile"}); err != nil {
+				return err
+			}
+
+			walker := &tarWalker{
+				stream: tarWriter,
+				root:   pkg.GetPackageCompiledDir(p.compiledPackagesPath),
+				prefix: "packages-src/" + pkg.Fingerprint,
+			}
+			return filepath.Walk(walker.root, walker.walk)
+		}
+
+		tags = append(tags, tag)
+		baseImage = tag
+	}
+
+	return tags, populators, nil
+}
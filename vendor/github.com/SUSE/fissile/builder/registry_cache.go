@@ -0,0 +1,161 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+
+	"github.com/SUSE/fissile/model"
+)
+
+// RegistryCache is a registry that may hold previously-built packages layer
+// images, consulted by determinePackagesLayerBaseImage so a build farm can
+// share incremental layers instead of every host rebuilding from the
+// stemcell.
+type RegistryCache struct {
+	// Repository is the docker reference (without tag) images are looked
+	// up under, e.g. "registry.example.com/fissile-packages".
+	Repository string
+	// SystemCtx carries auth for the registry; nil uses the default
+	// docker credential helpers.
+	SystemCtx *types.SystemContext
+}
+
+// registryCandidate is a remote image together with the fingerprint labels
+// it satisfies, so callers can pick the one maximizing overlap with the
+// requested packages.
+type registryCandidate struct {
+	reference string
+	labels    map[string]string
+}
+
+// bestMatch inspects every tag in the repository (via the registry's tag
+// list) and returns the image whose fingerprint.* labels intersect
+// requestedFingerprints the most, along with that intersection. It requires
+// the mandatory version.generator.fissile label to be present, with the
+// bare version (not the "key=value" form) as its value, on any candidate it
+// considers.
+func (c *RegistryCache) bestMatch(ctx context.Context, requestedFingerprints map[string]struct{}, fissileVersionValue string) (*registryCandidate, error) {
+	tags, err := c.listTags(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing tags in %s: %v", c.Repository, err)
+	}
+
+	var best *registryCandidate
+	bestScore := -1
+
+	for _, tag := range tags {
+		ref := fmt.Sprintf("docker://%s:%s", c.Repository, tag)
+		labels, err := c.inspectLabels(ctx, ref)
+		if err != nil {
+			// A single unreachable or malformed tag should not fail the
+			// whole lookup; it simply can't be used as a base image.
+			continue
+		}
+		if labels["version.generator.fissile"] != fissileVersionValue {
+			continue
+		}
+
+		score := 0
+		matched := make(map[string]string)
+		for label, value := range labels {
+			fingerprint := strings.TrimPrefix(label, "fingerprint.")
+			if fingerprint == label {
+				continue
+			}
+			if _, wanted := requestedFingerprints[fingerprint]; wanted {
+				score++
+				matched[label] = value
+			}
+		}
+
+		if score > bestScore {
+			bestScore = score
+			best = &registryCandidate{reference: fmt.Sprintf("%s:%s", c.Repository, tag), labels: matched}
+		}
+	}
+
+	return best, nil
+}
+
+// listRepositoryTags is a seam over docker.GetRepositoryTags so lookups can be
+// stubbed in tests.
+var listRepositoryTags = func(ctx context.Context, sys *types.SystemContext, repository string) ([]string, error) {
+	ref, err := docker.ParseReference(fmt.Sprintf("//%s", repository))
+	if err != nil {
+		return nil, err
+	}
+	return docker.GetRepositoryTags(ctx, sys, ref)
+}
+
+func (c *RegistryCache) listTags(ctx context.Context) ([]string, error) {
+	return listRepositoryTags(ctx, c.SystemCtx, c.Repository)
+}
+
+// inspectLabels fetches just the image config for ref and returns its
+// labels, without pulling any layer blobs.
+func (c *RegistryCache) inspectLabels(ctx context.Context, ref string) (map[string]string, error) {
+	imgRef, err := docker.ParseReference(strings.TrimPrefix(ref, "docker:"))
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := imgRef.NewImage(ctx, c.SystemCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	config, err := img.OCIConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return config.Config.Labels, nil
+}
+
+// determinePackagesLayerBaseImageWithRegistries extends
+// determinePackagesLayerBaseImage with one or more registries to consult in
+// addition to the local docker daemon. When a registry candidate covers more
+// of the requested packages than the local match, its remote image is
+// returned instead so the caller can pull just its config and layers on
+// demand.
+func (p *PackagesImageBuilder) determinePackagesLayerBaseImageWithRegistries(ctx context.Context, packages model.Packages, registries []RegistryCache) (string, model.Packages, error) {
+	localImage, localRemaining, err := p.determinePackagesLayerBaseImageLocal(packages)
+	if err != nil {
+		return "", nil, err
+	}
+
+	requested := make(map[string]struct{}, len(packages))
+	for _, pkg := range packages {
+		requested[pkg.Fingerprint] = struct{}{}
+	}
+	localMatched := len(packages) - len(localRemaining)
+
+	bestReference := localImage
+	bestRemaining := localRemaining
+	bestScore := localMatched
+
+	for _, registry := range registries {
+		candidate, err := registry.bestMatch(ctx, requested, p.fissileVersionValue())
+		if err != nil {
+			return "", nil, err
+		}
+		if candidate == nil || len(candidate.labels) <= bestScore {
+			continue
+		}
+
+		bestScore = len(candidate.labels)
+		bestReference = candidate.reference
+		bestRemaining = make(model.Packages, 0, len(packages)-bestScore)
+		for _, pkg := range packages {
+			if _, matched := candidate.labels[fmt.Sprintf("fingerprint.%s", pkg.Fingerprint)]; !matched {
+				bestRemaining = append(bestRemaining, pkg)
+			}
+		}
+	}
+
+	return bestReference, bestRemaining, nil
+}
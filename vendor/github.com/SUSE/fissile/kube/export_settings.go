@@ -0,0 +1,57 @@
+package kube
+
+// IngressConfig configures the Ingress/Gateway API resources
+// NewClusterIPServiceList generates for a role's public HTTP(S) ports.
+type IngressConfig struct {
+	// ClassName selects spec.ingressClassName on the generated Ingress
+	// (and doubles as the legacy kubernetes.io/ingress.class annotation
+	// for older ingress controllers).
+	ClassName string
+	// Host is the hostname routed to the role's public HTTP(S) ports.
+	Host string
+	// TLSSecretName, if set, requests a spec.tls entry naming this
+	// secret.
+	TLSSecretName string
+	// GatewayName is the Gateway API Gateway that generated HTTPRoutes
+	// attach to; only used when GatewayAPI is set.
+	GatewayName string
+}
+
+// NodePortRange bounds the node ports NewClusterIPService accepts from a
+// role manifest for ServiceVariantNodePort services. Kubernetes' own default (30000-32767) is
+// used when both fields are zero.
+type NodePortRange struct {
+	Min int
+	Max int
+}
+
+// ExportSettings carries the settings that influence how fissile renders
+// Kubernetes manifests for a role. Apart from the public service's external
+// IP (see CreateHelmChart), every value here is written into the generated
+// manifests literally; none is rendered as a .Values.kube.* Helm template
+// reference.
+type ExportSettings struct {
+	// CreateHelmChart switches literal values (e.g. the public service's
+	// externalIPs) for templated Helm value references.
+	CreateHelmChart bool
+
+	// GatewayAPI selects Gateway API HTTPRoute/Gateway resources instead
+	// of networking.k8s.io/v1 Ingress for a role's public HTTP(S) ports.
+	GatewayAPI bool
+	// IngressConfig configures the Ingress/HTTPRoute resources
+	// NewClusterIPServiceList generates.
+	IngressConfig IngressConfig
+
+	// NodePortRange bounds node ports for ServiceVariantNodePort
+	// services.
+	NodePortRange NodePortRange
+	// LoadBalancerSourceRanges restricts which client CIDRs a
+	// ServiceVariantLoadBalancer service accepts traffic from.
+	LoadBalancerSourceRanges []string
+	// ExternalTrafficPolicy sets spec.externalTrafficPolicy on
+	// ServiceVariantLoadBalancer services.
+	ExternalTrafficPolicy string
+	// LoadBalancerAnnotations are copied onto ServiceVariantLoadBalancer
+	// services' metadata, for cloud-provider hints such as internal-lb.
+	LoadBalancerAnnotations map[string]string
+}
@@ -0,0 +1,139 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SUSE/fissile/helm"
+	"github.com/SUSE/fissile/model"
+)
+
+// ingressItems returns the public HTTP(S) ingress resources for role as bare
+// Ingress or HTTPRoute nodes (without a wrapping v1 List): a
+// networking.k8s.io/v1 Ingress per port by default, or Gateway API HTTPRoute
+// resources when settings.GatewayAPI is set. It returns nil cleanly when the
+// role exposes no public HTTP(S) ports. NewClusterIPServiceList, the
+// top-level role export path, merges these into the same list it builds for
+// the role's services, so this is the only call site.
+func ingressItems(role *model.Role, settings ExportSettings) ([]helm.Node, error) {
+	httpPorts := publicHTTPPorts(role)
+	if len(httpPorts) == 0 {
+		return nil, nil
+	}
+
+	if settings.GatewayAPI {
+		return newHTTPRouteItems(role, httpPorts, settings)
+	}
+	return newIngressItems(role, httpPorts, settings)
+}
+
+// publicHTTPPorts returns the role's exposed ports that are both public and
+// carry an http/https protocol hint.
+func publicHTTPPorts(role *model.Role) []model.ExposedPort {
+	var ports []model.ExposedPort
+	for _, portDef := range role.Run.ExposedPorts {
+		if !portDef.Public {
+			continue
+		}
+		switch strings.ToLower(portDef.Protocol) {
+		case "http", "https":
+			ports = append(ports, portDef)
+		}
+	}
+	return ports
+}
+
+// newIngressItems builds a networking.k8s.io/v1 Ingress per public HTTP(S)
+// port, wiring host, TLS secret, and ingress class from settings. The path
+// is always "/" (pathType Prefix); settings do not change it.
+func newIngressItems(role *model.Role, ports []model.ExposedPort, settings ExportSettings) ([]helm.Node, error) {
+	var items []helm.Node
+	for _, portDef := range ports {
+		minPort, maxPort, err := parsePortRange(portDef.External, portDef.Name, "external")
+		if err != nil {
+			return nil, err
+		}
+		portInfos, err := getPortInfo(portDef.Name, minPort, maxPort)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, portInfoEntry := range portInfos {
+			ingress := newTypeMeta("networking.k8s.io/v1", "Ingress")
+
+			metadata := helm.NewMapping("name", fmt.Sprintf("%s-%s", role.Name, portInfoEntry.name))
+			if settings.IngressConfig.ClassName != "" {
+				metadata.Add("annotations", helm.NewMapping(
+					"kubernetes.io/ingress.class", settings.IngressConfig.ClassName))
+			}
+			ingress.Add("metadata", metadata)
+
+			host := settings.IngressConfig.Host
+			path := "/"
+			rule := helm.NewMapping("host", host)
+			pathType := "Prefix"
+			httpPath := helm.NewMapping("path", path, "pathType", pathType)
+			httpPath.Add("backend", helm.NewMapping("service", helm.NewMapping(
+				"name", role.Name,
+				"port", helm.NewMapping("name", portInfoEntry.name),
+			)))
+			rule.Add("http", helm.NewMapping("paths", helm.NewList(httpPath)))
+
+			spec := helm.NewMapping()
+			if settings.IngressConfig.ClassName != "" {
+				spec.Add("ingressClassName", settings.IngressConfig.ClassName)
+			}
+			if settings.IngressConfig.TLSSecretName != "" {
+				spec.Add("tls", helm.NewList(helm.NewMapping(
+					"hosts", helm.NewList(host),
+					"secretName", settings.IngressConfig.TLSSecretName,
+				)))
+			}
+			spec.Add("rules", helm.NewList(rule))
+
+			ingress.Add("spec", spec.Sort())
+			items = append(items, ingress)
+		}
+	}
+
+	return items, nil
+}
+
+// newHTTPRouteItems builds Gateway API HTTPRoute resources (one per public
+// HTTP(S) port) that attach to the Gateway named in
+// settings.IngressConfig.GatewayName, for charts targeting modern clusters
+// that prefer Gateway API over Ingress.
+func newHTTPRouteItems(role *model.Role, ports []model.ExposedPort, settings ExportSettings) ([]helm.Node, error) {
+	var items []helm.Node
+	for _, portDef := range ports {
+		minPort, maxPort, err := parsePortRange(portDef.External, portDef.Name, "external")
+		if err != nil {
+			return nil, err
+		}
+		portInfos, err := getPortInfo(portDef.Name, minPort, maxPort)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, portInfoEntry := range portInfos {
+			route := newTypeMeta("gateway.networking.k8s.io/v1", "HTTPRoute")
+			route.Add("metadata", helm.NewMapping("name", fmt.Sprintf("%s-%s", role.Name, portInfoEntry.name)))
+
+			spec := helm.NewMapping()
+			spec.Add("parentRefs", helm.NewList(helm.NewMapping("name", settings.IngressConfig.GatewayName)))
+			if settings.IngressConfig.Host != "" {
+				spec.Add("hostnames", helm.NewList(settings.IngressConfig.Host))
+			}
+			rule := helm.NewMapping("backendRefs", helm.NewList(helm.NewMapping(
+				"name", role.Name,
+				"port", portInfoEntry.port,
+			)))
+			spec.Add("rules", helm.NewList(rule))
+
+			route.Add("spec", spec.Sort())
+			items = append(items, route)
+		}
+	}
+
+	return items, nil
+}
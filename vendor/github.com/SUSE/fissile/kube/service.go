@@ -8,13 +8,77 @@ import (
 	"github.com/SUSE/fissile/model"
 )
 
-// NewClusterIPServiceList creates a list of ClusterIP services
-func NewClusterIPServiceList(role *model.Role, headless bool, settings ExportSettings) (helm.Node, error) {
-	var items []helm.Node
+// ServiceVariant identifies the kind of Kubernetes Service to generate for a
+// role. It replaces the old three-way headless/public/private boolean flags
+// so a role manifest can request any combination a role needs, including
+// the node-port, load-balancer, and external-name forms.
+type ServiceVariant int
+
+const (
+	// ServiceVariantHeadless is a headless (clusterIP: None) service used
+	// for StatefulSet pod DNS.
+	ServiceVariantHeadless ServiceVariant = iota
+	// ServiceVariantPrivate is the normal in-cluster ClusterIP service.
+	ServiceVariantPrivate
+	// ServiceVariantPublic is a ClusterIP service additionally exposed via
+	// externalIPs.
+	ServiceVariantPublic
+	// ServiceVariantNodePort exposes the role's public ports on a port
+	// allocated on every cluster node.
+	ServiceVariantNodePort
+	// ServiceVariantLoadBalancer requests a cloud load balancer in front
+	// of the role's public ports.
+	ServiceVariantLoadBalancer
+	// ServiceVariantExternalName proxies the service name to an
+	// out-of-cluster DNS name via a CNAME, for roles that front an
+	// external dependency.
+	ServiceVariantExternalName
+)
+
+// serviceName returns the Service metadata.name for a role/variant pair,
+// matching the suffixes the headless/public booleans used to produce.
+func (v ServiceVariant) serviceName(role *model.Role) string {
+	switch v {
+	case ServiceVariantHeadless:
+		return fmt.Sprintf("%s-set", role.Name)
+	case ServiceVariantPublic:
+		return fmt.Sprintf("%s-public", role.Name)
+	case ServiceVariantNodePort:
+		return fmt.Sprintf("%s-nodeport", role.Name)
+	case ServiceVariantLoadBalancer:
+		return fmt.Sprintf("%s-lb", role.Name)
+	case ServiceVariantExternalName:
+		return fmt.Sprintf("%s-external", role.Name)
+	default:
+		return role.Name
+	}
+}
 
+// NewClusterIPServiceList creates the list of Services (and, where the role
+// exposes public HTTP(S) ports, the Ingress/Gateway API resources
+// ingressItems generates) for role: the headless (when headless is set),
+// private and public ClusterIP services it always had, plus a NodePort, LoadBalancer, or ExternalName service for
+// each variant the role manifest declares via role.Run.ServiceVariants().
+// This is the top-level role export path and the only caller of
+// ingressItems, so a role's Ingress/HTTPRoute resources are never emitted
+// more than once.
+func NewClusterIPServiceList(role *model.Role, headless bool, settings ExportSettings) (helm.Node, error) {
+	variants := []ServiceVariant{}
 	if headless {
-		// Create headless, private service
-		svc, err := NewClusterIPService(role, true, false, settings)
+		variants = append(variants, ServiceVariantHeadless)
+	}
+	variants = append(variants, ServiceVariantPrivate, ServiceVariantPublic)
+	for _, name := range role.Run.ServiceVariants() {
+		variant, err := parseServiceVariant(name)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+
+	var items []helm.Node
+	for _, variant := range variants {
+		svc, err := NewClusterIPService(role, variant, settings)
 		if err != nil {
 			return nil, err
 		}
@@ -23,22 +87,12 @@ func NewClusterIPServiceList(role *model.Role, headless bool, settings ExportSet
 		}
 	}
 
-	// Create private service
-	svc, err := NewClusterIPService(role, false, false, settings)
+	ingress, err := ingressItems(role, settings)
 	if err != nil {
 		return nil, err
 	}
-	if svc != nil {
-		items = append(items, svc)
-	}
-	// Create public service
-	svc, err = NewClusterIPService(role, false, true, settings)
-	if err != nil {
-		return nil, err
-	}
-	if svc != nil {
-		items = append(items, svc)
-	}
+	items = append(items, ingress...)
+
 	if len(items) == 0 {
 		return nil, nil
 	}
@@ -49,11 +103,32 @@ func NewClusterIPServiceList(role *model.Role, headless bool, settings ExportSet
 	return list.Sort(), nil
 }
 
-// NewClusterIPService creates a new k8s ClusterIP service
-func NewClusterIPService(role *model.Role, headless bool, public bool, settings ExportSettings) (helm.Node, error) {
+// parseServiceVariant converts one of the role manifest's
+// service.variants entries (model.RoleRun.ServiceVariants()) into the
+// ServiceVariant it names.
+func parseServiceVariant(name string) (ServiceVariant, error) {
+	switch name {
+	case "node-port":
+		return ServiceVariantNodePort, nil
+	case "load-balancer":
+		return ServiceVariantLoadBalancer, nil
+	case "external-name":
+		return ServiceVariantExternalName, nil
+	default:
+		return 0, fmt.Errorf("role manifest requested unknown service variant %q", name)
+	}
+}
+
+// NewClusterIPService creates a new k8s Service for role in the requested
+// variant.
+func NewClusterIPService(role *model.Role, variant ServiceVariant, settings ExportSettings) (helm.Node, error) {
+	if variant == ServiceVariantExternalName {
+		return newExternalNameService(role, settings)
+	}
+
 	var ports []helm.Node
 	for _, portDef := range role.Run.ExposedPorts {
-		if public && !portDef.Public {
+		if (variant == ServiceVariantPublic || variant == ServiceVariantNodePort || variant == ServiceVariantLoadBalancer) && !portDef.Public {
 			continue
 		}
 		minPort, maxPort, err := parsePortRange(portDef.External, portDef.Name, "external")
@@ -71,11 +146,23 @@ func NewClusterIPService(role *model.Role, headless bool, public bool, settings
 				"port", portInfoEntry.port,
 				"protocol", strings.ToUpper(portDef.Protocol),
 			)
-			if headless {
+			if variant == ServiceVariantHeadless {
 				port.Add("targetPort", 0)
 			} else {
 				port.Add("targetPort", portInfoEntry.name)
 			}
+			if variant == ServiceVariantNodePort && portDef.NodePort != 0 {
+				// A node port comes from its own range (30000-32767 unless
+				// settings.NodePortRange sets another), independent of the
+				// service port; only set it when the
+				// role manifest declared one explicitly, and otherwise
+				// leave it unset so the apiserver allocates it.
+				nodePort, err := nodePortFor(portDef.NodePort, settings)
+				if err != nil {
+					return nil, err
+				}
+				port.Add("nodePort", nodePort)
+			}
 			ports = append(ports, port)
 		}
 	}
@@ -87,29 +174,100 @@ func NewClusterIPService(role *model.Role, headless bool, public bool, settings
 
 	spec := helm.NewMapping()
 	spec.Add("selector", helm.NewMapping(RoleNameLabel, role.Name))
-	spec.Add("type", "ClusterIP")
-	if headless {
+	spec.Add("type", serviceType(variant))
+
+	switch variant {
+	case ServiceVariantHeadless:
 		spec.Add("clusterIP", "None")
-	}
-	if public {
+	case ServiceVariantPublic:
 		externalIP := "192.168.77.77"
 		if settings.CreateHelmChart {
 			externalIP = "{{ .Values.kube.external_ip | quote }}"
 		}
 		spec.Add("externalIPs", helm.NewList(externalIP))
+	case ServiceVariantLoadBalancer:
+		if len(settings.LoadBalancerSourceRanges) > 0 {
+			ranges := make([]interface{}, len(settings.LoadBalancerSourceRanges))
+			for i, r := range settings.LoadBalancerSourceRanges {
+				ranges[i] = r
+			}
+			spec.Add("loadBalancerSourceRanges", helm.NewList(ranges...))
+		}
+		if settings.ExternalTrafficPolicy != "" {
+			spec.Add("externalTrafficPolicy", settings.ExternalTrafficPolicy)
+		}
 	}
+
 	spec.Add("ports", helm.NewNode(ports))
 
-	serviceName := role.Name
-	if headless {
-		serviceName = fmt.Sprintf("%s-set", role.Name)
-	} else if public {
-		serviceName = fmt.Sprintf("%s-public", role.Name)
+	service := newTypeMeta("v1", "Service")
+	metadata := helm.NewMapping("name", variant.serviceName(role))
+	if variant == ServiceVariantLoadBalancer {
+		addCloudAnnotations(metadata, settings)
+	}
+	service.Add("metadata", metadata)
+	service.Add("spec", spec.Sort())
+
+	return service, nil
+}
+
+// newExternalNameService creates a Service of type ExternalName, which
+// proxies in-cluster traffic for role's service name to an out-of-cluster
+// DNS name via CNAME, instead of selecting pods.
+func newExternalNameService(role *model.Role, settings ExportSettings) (helm.Node, error) {
+	externalName := role.Run.ExternalName
+	if externalName == "" {
+		return nil, nil
 	}
 
+	spec := helm.NewMapping()
+	spec.Add("type", "ExternalName")
+	spec.Add("externalName", externalName)
+
 	service := newTypeMeta("v1", "Service")
-	service.Add("metadata", helm.NewMapping("name", serviceName))
+	service.Add("metadata", helm.NewMapping("name", ServiceVariantExternalName.serviceName(role)))
 	service.Add("spec", spec.Sort())
 
 	return service, nil
 }
+
+// serviceType returns the Kubernetes spec.type value for variant.
+func serviceType(variant ServiceVariant) string {
+	switch variant {
+	case ServiceVariantNodePort:
+		return "NodePort"
+	case ServiceVariantLoadBalancer:
+		return "LoadBalancer"
+	case ServiceVariantExternalName:
+		return "ExternalName"
+	default:
+		return "ClusterIP"
+	}
+}
+
+// nodePortFor validates port against settings.NodePortRange (defaulting to
+// Kubernetes' own 30000-32767 default) and returns it unchanged; it exists
+// as a seam so the range can be enforced consistently and reported clearly.
+func nodePortFor(port int, settings ExportSettings) (int, error) {
+	minPort, maxPort := 30000, 32767
+	if settings.NodePortRange.Min != 0 || settings.NodePortRange.Max != 0 {
+		minPort, maxPort = settings.NodePortRange.Min, settings.NodePortRange.Max
+	}
+	if port < minPort || port > maxPort {
+		return 0, fmt.Errorf("node port %d is outside the allowed range %d-%d", port, minPort, maxPort)
+	}
+	return port, nil
+}
+
+// addCloudAnnotations copies any cloud-provider annotations configured for
+// LoadBalancer services (e.g. internal-lb hints) onto the service metadata.
+func addCloudAnnotations(metadata *helm.Mapping, settings ExportSettings) {
+	if len(settings.LoadBalancerAnnotations) == 0 {
+		return
+	}
+	annotations := helm.NewMapping()
+	for key, value := range settings.LoadBalancerAnnotations {
+		annotations.Add(key, value)
+	}
+	metadata.Add("annotations", annotations.Sort())
+}
@@ -0,0 +1,48 @@
+package model
+
+// ExposedPort describes a single port a role's job listens on, and how it
+// should be surfaced outside the pod.
+type ExposedPort struct {
+	Name     string `yaml:"name"`
+	Protocol string `yaml:"protocol"`
+	External string `yaml:"external"`
+	Public   bool   `yaml:"public"`
+
+	// NodePort is the node port to request when the role's manifest asks
+	// for a "node-port" service variant. It is independent of the
+	// service port above; when zero, the port is left unset so the
+	// apiserver allocates one from its own NodePort range.
+	NodePort int `yaml:"node-port"`
+}
+
+// RoleService configures the additional Kubernetes Service kinds a role's
+// manifest can request, under the run entry's "service" key.
+type RoleService struct {
+	// Variants lists the additional service kinds (beyond the
+	// headless/private/public ClusterIP ones, which need no entry here) the role
+	// manifest requests, e.g. "node-port", "load-balancer",
+	// "external-name".
+	Variants []string `yaml:"variants"`
+}
+
+// RoleRun captures the runtime configuration of a role relevant to
+// exporting Kubernetes manifests.
+type RoleRun struct {
+	ExposedPorts []ExposedPort `yaml:"exposed-ports"`
+
+	// ExternalName is the out-of-cluster DNS name that the role's
+	// "external-name" service variant (an extra <role>-external Service of
+	// type ExternalName) points at. It has no effect unless that variant
+	// is requested, and that Service is not generated while it is empty.
+	ExternalName string `yaml:"external-name"`
+
+	// Service holds the role manifest's "service.variants" request; use
+	// ServiceVariants to read it.
+	Service RoleService `yaml:"service"`
+}
+
+// ServiceVariants returns the additional service kinds this role's
+// manifest requested.
+func (r *RoleRun) ServiceVariants() []string {
+	return r.Service.Variants
+}